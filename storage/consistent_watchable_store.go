@@ -17,6 +17,8 @@ package storage
 import (
 	"encoding/binary"
 	"log"
+	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -39,6 +41,19 @@ type consistentWatchableStore struct {
 	// underlying backend. This helps to recover consistent index
 	// when restoring.
 	ig ConsistentIndexGetter
+
+	// consistentIndex caches the index last seen from ig so ConsistentIndex
+	// can be read lock-free; it is refreshed on every TxnBegin.
+	consistentIndex uint64
+	// indexDirty is 1 when consistentIndex has advanced since it was last
+	// written to the backend, and is cleared once saveIndex persists it.
+	// It only short-circuits redundant saves; indexMu is what makes
+	// saveIndex safe to call concurrently.
+	indexDirty int32
+	// indexMu serializes saveIndex so two concurrent Commit callers can't
+	// both pass the indexDirty check and race each other. The backend's own
+	// periodic flush does not go through Commit and does not save the index.
+	indexMu sync.Mutex
 }
 
 func New(path string, ig ConsistentIndexGetter) ConsistentWatchableKV {
@@ -49,10 +64,27 @@ func New(path string, ig ConsistentIndexGetter) ConsistentWatchableKV {
 // using the file at the given path.
 // If the file at the given path does not exist then it will be created automatically.
 func newConsistentWatchableStore(path string, ig ConsistentIndexGetter) *consistentWatchableStore {
-	return &consistentWatchableStore{
+	s := &consistentWatchableStore{
 		watchableStore: newWatchableStore(path),
 		ig:             ig,
 	}
+	s.consistentIndex = s.readConsistentIndex()
+	return s
+}
+
+// readConsistentIndex reads the persisted consistent index from the
+// backend. It is only called once, at open, since every later read goes
+// through the in-memory cache.
+func (s *consistentWatchableStore) readConsistentIndex() uint64 {
+	tx := s.watchableStore.store.b.BatchTx()
+	tx.Lock()
+	defer tx.Unlock()
+
+	_, vs := tx.UnsafeRange(metaBucketName, consistentIndexKeyName, nil, 0)
+	if len(vs) == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(vs[0])
 }
 
 func (s *consistentWatchableStore) Put(key, value []byte) (rev int64) {
@@ -79,28 +111,57 @@ func (s *consistentWatchableStore) DeleteRange(key, end []byte) (n, rev int64) {
 	return n, rev
 }
 
+// TxnBegin refreshes the in-memory consistent index from ig and defers the
+// backend write: the index is only ever persisted by saveIndex, at the next
+// Commit or snapshot boundary, so a high-rate caller no longer pays an
+// UnsafePut on every single txn.
 func (s *consistentWatchableStore) TxnBegin() int64 {
 	id := s.watchableStore.TxnBegin()
 
-	// TODO: avoid this unnecessary allocation
-	bs := make([]byte, 8)
-	binary.BigEndian.PutUint64(bs, s.ig.ConsistentIndex())
-	// put the index into the underlying backend
-	// tx has been locked in TxnBegin, so there is no need to lock it again
-	s.watchableStore.store.tx.UnsafePut(metaBucketName, consistentIndexKeyName, bs)
+	if ci := s.ig.ConsistentIndex(); atomic.SwapUint64(&s.consistentIndex, ci) != ci {
+		atomic.StoreInt32(&s.indexDirty, 1)
+	}
 
 	return id
 }
 
-func (s *consistentWatchableStore) ConsistentIndex() uint64 {
+// Commit flushes the cached consistent index into the current backend batch
+// before committing it. The ops of the txns up to that index are already in
+// the backend by then, either in this batch or in one the backend committed
+// earlier, so the persisted index is never ahead of them.
+func (s *consistentWatchableStore) Commit() {
+	s.saveIndex()
+	s.watchableStore.Commit()
+}
+
+// saveIndex persists consistentIndex to the backend if it has changed since
+// the last save. On restart, etcdserver reads this value back and replays
+// the raft log starting at it; the invariant that makes this safe is that
+// the persisted index is always <= the index of the last fully-committed
+// backend batch, so replay only ever re-applies entries whose effects may
+// already be on disk, never skips one that isn't.
+//
+// indexMu holds the whole check-encode-put sequence so two concurrent
+// callers can't both see indexDirty==1 and step on each other's encode.
+func (s *consistentWatchableStore) saveIndex() {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	if !atomic.CompareAndSwapInt32(&s.indexDirty, 1, 0) {
+		return
+	}
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], atomic.LoadUint64(&s.consistentIndex))
+
 	tx := s.watchableStore.store.b.BatchTx()
 	tx.Lock()
-	defer tx.Unlock()
+	tx.UnsafePut(metaBucketName, consistentIndexKeyName, buf[:])
+	tx.Unlock()
+}
 
-	// get the index
-	_, vs := tx.UnsafeRange(metaBucketName, consistentIndexKeyName, nil, 0)
-	if len(vs) == 0 {
-		return 0
-	}
-	return binary.BigEndian.Uint64(vs[0])
+// ConsistentIndex returns the cached consistent index with a lock-free
+// atomic load; TxnBegin keeps it in sync with ig on every txn.
+func (s *consistentWatchableStore) ConsistentIndex() uint64 {
+	return atomic.LoadUint64(&s.consistentIndex)
 }
@@ -0,0 +1,215 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"log"
+
+	"github.com/coreos/etcd/storage/storagepb"
+)
+
+// CompareTarget is the field of a key's metadata that a Compare evaluates.
+type CompareTarget int
+
+const (
+	CompareVersion CompareTarget = iota
+	CompareCreated
+	CompareModified
+	CompareValue
+)
+
+// CompareResult is the relation a Compare requires between the target
+// field and the value it carries.
+type CompareResult int
+
+const (
+	CompareEqual CompareResult = iota
+	CompareGreater
+	CompareLess
+)
+
+// Compare is a single predicate evaluated against the current state of a
+// key. A Txn only takes its success path if every Compare in it holds.
+type Compare struct {
+	Key    []byte
+	Target CompareTarget
+	Result CompareResult
+
+	// Version, CreateRevision, ModRevision and Value hold the right-hand
+	// side of the comparison; only the field matching Target is read. A
+	// key that does not exist compares as the zero value of Target.
+	Version        int64
+	CreateRevision int64
+	ModRevision    int64
+	Value          []byte
+}
+
+// OpType is the kind of mutation an Op applies.
+type OpType int
+
+const (
+	OpPutType OpType = iota
+	OpDeleteRangeType
+)
+
+// Op is a single Put or DeleteRange to apply as part of a Txn.
+type Op struct {
+	Type  OpType
+	Key   []byte
+	End   []byte
+	Value []byte
+}
+
+// OpPut returns an Op that puts key/value.
+func OpPut(key, value []byte) Op {
+	return Op{Type: OpPutType, Key: key, Value: value}
+}
+
+// OpDelete returns an Op that deletes the range [key, end). If end is nil,
+// only key is deleted.
+func OpDelete(key, end []byte) Op {
+	return Op{Type: OpDeleteRangeType, Key: key, End: end}
+}
+
+// OpResult is the outcome of a single Op applied by a Txn.
+type OpResult struct {
+	// Rev is the revision of the store after the op was applied.
+	Rev int64
+	// Deleted is the number of keys removed; only set for delete ops.
+	Deleted int64
+}
+
+// TxnResponse is the result of a Txn call.
+type TxnResponse struct {
+	// Succeeded reports whether every Compare held, i.e. whether success
+	// (rather than failure) was applied.
+	Succeeded bool
+	Responses []OpResult
+}
+
+// Txn atomically evaluates cmps against the current state of the store and
+// applies success if every one of them holds, or failure otherwise. The
+// comparisons and the resulting ops run inside the same txn id that
+// TxnBegin/TxnEnd bracket, so the evaluation can never race with another
+// TxnBegin/TxnEnd pair. The consistent index is only cached in memory by
+// TxnBegin; it is persisted lazily by saveIndex at the next Commit, which
+// may land in a later backend batch than the one holding this Txn's ops.
+// That's fine for restart replay, which only requires the persisted index
+// to never be ahead of the ops it accompanies, never that it be in lock
+// step with them.
+func (s *consistentWatchableStore) Txn(cmps []Compare, success, failure []Op) (TxnResponse, error) {
+	id := s.TxnBegin()
+	defer func() {
+		if err := s.TxnEnd(id); err != nil {
+			log.Panicf("unexpected TxnEnd error (%v)", err)
+		}
+	}()
+
+	ok, err := s.txnApplyCompares(id, cmps)
+	if err != nil {
+		return TxnResponse{}, err
+	}
+
+	ops := success
+	if !ok {
+		ops = failure
+	}
+
+	resp := TxnResponse{Succeeded: ok}
+	for _, op := range ops {
+		r, err := s.txnApplyOp(id, op)
+		if err != nil {
+			return TxnResponse{}, err
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, nil
+}
+
+// txnApplyCompares reports whether every cmp holds against the state
+// visible inside txn id.
+func (s *consistentWatchableStore) txnApplyCompares(id int64, cmps []Compare) (bool, error) {
+	for _, cmp := range cmps {
+		kvs, _, err := s.TxnRange(id, cmp.Key, nil, 1, 0)
+		if err != nil {
+			return false, err
+		}
+
+		var kv storagepb.KeyValue
+		if len(kvs) > 0 {
+			kv = kvs[0]
+		}
+
+		if !compareKV(cmp, kv) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// compareKV evaluates cmp against kv. A missing key is treated as the
+// zero-valued KeyValue, so e.g. a CompareEqual against CompareVersion 0
+// can be used to assert that a key does not exist.
+func compareKV(cmp Compare, kv storagepb.KeyValue) bool {
+	var result int
+	switch cmp.Target {
+	case CompareVersion:
+		result = compareInt64(kv.Version, cmp.Version)
+	case CompareCreated:
+		result = compareInt64(kv.CreateRevision, cmp.CreateRevision)
+	case CompareModified:
+		result = compareInt64(kv.ModRevision, cmp.ModRevision)
+	case CompareValue:
+		result = bytes.Compare(kv.Value, cmp.Value)
+	}
+
+	switch cmp.Result {
+	case CompareEqual:
+		return result == 0
+	case CompareGreater:
+		return result > 0
+	case CompareLess:
+		return result < 0
+	default:
+		return false
+	}
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// txnApplyOp applies a single Op inside txn id.
+func (s *consistentWatchableStore) txnApplyOp(id int64, op Op) (OpResult, error) {
+	switch op.Type {
+	case OpPutType:
+		rev, err := s.TxnPut(id, op.Key, op.Value)
+		return OpResult{Rev: rev}, err
+	case OpDeleteRangeType:
+		n, rev, err := s.TxnDeleteRange(id, op.Key, op.End)
+		return OpResult{Rev: rev, Deleted: n}, err
+	default:
+		log.Panicf("unknown op type %v", op.Type)
+		return OpResult{}, nil
+	}
+}
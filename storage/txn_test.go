@@ -0,0 +1,174 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/storage/storagepb"
+)
+
+func TestCompareKV(t *testing.T) {
+	kv := storagepb.KeyValue{
+		Version:        3,
+		CreateRevision: 2,
+		ModRevision:    5,
+		Value:          []byte("bar"),
+	}
+
+	tests := []struct {
+		name string
+		cmp  Compare
+		want bool
+	}{
+		{"version equal", Compare{Target: CompareVersion, Result: CompareEqual, Version: 3}, true},
+		{"version not equal", Compare{Target: CompareVersion, Result: CompareEqual, Version: 4}, false},
+		{"version greater", Compare{Target: CompareVersion, Result: CompareGreater, Version: 2}, true},
+		{"version less", Compare{Target: CompareVersion, Result: CompareLess, Version: 4}, true},
+		{"created equal", Compare{Target: CompareCreated, Result: CompareEqual, CreateRevision: 2}, true},
+		{"created greater false", Compare{Target: CompareCreated, Result: CompareGreater, CreateRevision: 2}, false},
+		{"modified equal", Compare{Target: CompareModified, Result: CompareEqual, ModRevision: 5}, true},
+		{"modified less false", Compare{Target: CompareModified, Result: CompareLess, ModRevision: 5}, false},
+		{"value equal", Compare{Target: CompareValue, Result: CompareEqual, Value: []byte("bar")}, true},
+		{"value not equal", Compare{Target: CompareValue, Result: CompareEqual, Value: []byte("baz")}, false},
+		{"value greater", Compare{Target: CompareValue, Result: CompareGreater, Value: []byte("abc")}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareKV(tt.cmp, kv); got != tt.want {
+				t.Errorf("compareKV(%+v, %+v) = %v, want %v", tt.cmp, kv, got, tt.want)
+			}
+		})
+	}
+
+	// A missing key is treated as the zero-valued KeyValue, so a
+	// CompareEqual against CompareVersion 0 asserts non-existence.
+	var missing storagepb.KeyValue
+	missingTests := []struct {
+		name string
+		cmp  Compare
+		want bool
+	}{
+		{"missing key version zero", Compare{Target: CompareVersion, Result: CompareEqual, Version: 0}, true},
+		{"missing key created zero", Compare{Target: CompareCreated, Result: CompareEqual, CreateRevision: 0}, true},
+		{"missing key value empty", Compare{Target: CompareValue, Result: CompareEqual, Value: nil}, true},
+	}
+
+	for _, tt := range missingTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compareKV(tt.cmp, missing); got != tt.want {
+				t.Errorf("compareKV(%+v, %+v) = %v, want %v", tt.cmp, missing, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("missing key via zero value", func(t *testing.T) {
+		var zero storagepb.KeyValue
+		cmp := Compare{Target: CompareVersion, Result: CompareEqual, Version: 0}
+		if !compareKV(cmp, zero) {
+			t.Errorf("compareKV against a missing key did not treat it as version 0")
+		}
+	})
+}
+
+func TestTxnAppliesSuccessOps(t *testing.T) {
+	var ig fakeConsistentIndex
+	s, cleanup := newTestConsistentWatchableStore(t, &ig)
+	defer cleanup()
+
+	key, initial := []byte("foo"), []byte("bar")
+	rev := s.Put(key, initial)
+
+	cmps := []Compare{{Key: key, Target: CompareModified, Result: CompareEqual, ModRevision: rev}}
+	success := []Op{OpPut(key, []byte("success"))}
+	failure := []Op{OpPut(key, []byte("failure"))}
+
+	resp, err := s.Txn(cmps, success, failure)
+	if err != nil {
+		t.Fatalf("unexpected Txn error: %v", err)
+	}
+	if !resp.Succeeded {
+		t.Fatalf("Txn.Succeeded = false, want true")
+	}
+
+	kvs, _, err := s.Range(key, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected Range error: %v", err)
+	}
+	if len(kvs) != 1 || string(kvs[0].Value) != "success" {
+		t.Fatalf("Range(%q) = %+v, want value %q", key, kvs, "success")
+	}
+}
+
+func TestTxnAppliesFailureOps(t *testing.T) {
+	var ig fakeConsistentIndex
+	s, cleanup := newTestConsistentWatchableStore(t, &ig)
+	defer cleanup()
+
+	key := []byte("foo")
+	s.Put(key, []byte("bar"))
+
+	cmps := []Compare{{Key: key, Target: CompareModified, Result: CompareEqual, ModRevision: 999}}
+	success := []Op{OpPut(key, []byte("success"))}
+	failure := []Op{OpPut(key, []byte("failure"))}
+
+	resp, err := s.Txn(cmps, success, failure)
+	if err != nil {
+		t.Fatalf("unexpected Txn error: %v", err)
+	}
+	if resp.Succeeded {
+		t.Fatalf("Txn.Succeeded = true, want false")
+	}
+
+	kvs, _, err := s.Range(key, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected Range error: %v", err)
+	}
+	if len(kvs) != 1 || string(kvs[0].Value) != "failure" {
+		t.Fatalf("Range(%q) = %+v, want value %q", key, kvs, "failure")
+	}
+}
+
+// TestTxnReleasesLock guards the defer in Txn that runs TxnEnd regardless of
+// how txnApplyCompares/txnApplyOp returned: if it were ever skipped, the txn
+// lock taken by TxnBegin would never be released and this TxnBegin call
+// would hang.
+func TestTxnReleasesLock(t *testing.T) {
+	var ig fakeConsistentIndex
+	s, cleanup := newTestConsistentWatchableStore(t, &ig)
+	defer cleanup()
+
+	key := []byte("foo")
+	s.Put(key, []byte("bar"))
+
+	cmps := []Compare{{Key: key, Target: CompareModified, Result: CompareEqual, ModRevision: 999}}
+	if _, err := s.Txn(cmps, []Op{OpPut(key, []byte("success"))}, []Op{OpPut(key, []byte("failure"))}); err != nil {
+		t.Fatalf("unexpected Txn error: %v", err)
+	}
+
+	done := make(chan int64, 1)
+	go func() { done <- s.TxnBegin() }()
+
+	select {
+	case id := <-done:
+		if err := s.TxnEnd(id); err != nil {
+			t.Fatalf("unexpected TxnEnd error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TxnBegin blocked after Txn returned; TxnEnd was not called")
+	}
+}